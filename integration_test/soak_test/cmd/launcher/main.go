@@ -15,13 +15,15 @@
 //go:build integration_test
 
 /*
-The launcher command launches a VM and begins a soak test on it.
+The launcher command launches one or more VMs and begins a soak test on
+each of them.
 
 Specifically, it installs the Ops Agent and a Python program that
 logs to a specific file that the Ops Agent is watching.
 
-This command is configured by the following environment variables,
-in addition to the ones at the top of gce_testing.go:
+In its default, single-VM mode, this command is configured by the
+following environment variables, in addition to the ones at the top of
+gce_testing.go:
 
 LOG_RATE: How many log entries per second to send to the Ops Agent.
 
@@ -34,6 +36,42 @@ DISTRO: The GCE image family name to run, e.g. "debian-11".
 VM_NAME: (Optional) The name of the VM to spawn. If not supplied,
 a random name will be generated by gce_testing.go.
 
+LOG_TRANSPORT: (Optional) Which Ops Agent receiver type to exercise:
+"files" (the default), "syslog" (TCP) / "syslog_udp" (UDP),
+"tcp" / "fluent_forward", "eventlog" (Windows only), or
+"docker_json_file" (runs the generator in a container and reads back
+through Docker's json-file logging driver).
+
+VERIFY_DELIVERY: (Optional) If "true", close the loop on the soak by
+measuring what fraction of generated log entries actually made it to
+Cloud Logging, and fail the run if too many were lost.
+
+VERIFICATION_MODE: (Optional) Either "logging_api" (the default), which
+polls the Cloud Logging API for entries tagged with this run's UUID, or
+"pubsub", which drains a log sink through VERIFICATION_PUBSUB_TOPIC /
+VERIFICATION_PUBSUB_SUBSCRIPTION instead.
+
+MAX_LOSS_PCT: (Optional) The maximum acceptable loss percentage, over
+the life of the run, before VERIFY_DELIVERY causes the launcher to fail.
+Defaults to "1.0".
+
+RESOURCE_SAMPLING_ENABLED: (Optional) If "true", sample the Ops Agent's
+own CPU/RSS/fd/disk-I/O usage throughout the run and report percentile
+summaries at the end, turning the soak into a performance-regression
+detector rather than just a "does it crash?" check.
+
+RESOURCE_SAMPLING_INTERVAL: (Optional) How often to sample. Defaults to
+"30s".
+
+RESOURCE_SAMPLING_CSV: (Optional) Where to append raw samples, as CSV,
+on the machine running the launcher. Defaults to
+"/tmp/ops_agent_resource_samples.csv".
+
+RESOURCE_SAMPLING_BASELINE_FILE: (Optional) A JSON file of prior runs'
+percentile summaries, keyed by (distro, log_rate, log_size_in_bytes).
+If set, a run whose p95 CPU or RSS is more than 20% worse than its
+baseline logs a regression warning.
+
 For example, after replacing `my_project` with a real project, you
 could run it like:
 
@@ -46,37 +84,56 @@ PROJECT=my_project \
   LOG_RATE=1000 \
 	go run -tags=integration_test .
 ```
+
+FLEET_JOB_FILE: (Optional) Instead of reading the variables above, read
+a YAML or JSON job file describing a matrix of (distro, log_rate,
+log_size) tuples to soak-test concurrently, and report an aggregated
+summary at the end. See the fleet package for the job file format. When
+this is set, LOG_RATE, LOG_SIZE_IN_BYTES, DISTRO, and VM_NAME are
+ignored.
+
+LEAVE_RUNNING_ON_SHUTDOWN: (Optional) If "true", an interrupted run
+(Ctrl-C, SIGTERM, or a detected preemption) leaves its VM(s) running
+until their ttl label expires, instead of deleting them immediately.
+Useful for inspecting a VM's state after a failure.
+
+On SIGINT/SIGTERM the launcher cancels the run, tears down (or, per
+LEAVE_RUNNING_ON_SHUTDOWN, leaves alone) any VM(s) it created, and exits
+nonzero. Before creating a new VM, it also reconciles any stragglers
+left behind by a previous run that didn't shut down cleanly.
 */
 
 package main
 
 import (
 	"context"
-	_ "embed"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
-	"github.com/GoogleCloudPlatform/ops-agent/integration_test/agents"
 	"github.com/GoogleCloudPlatform/ops-agent/integration_test/gce"
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/soak_test/fleet"
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/soak_test/soak"
 )
 
 var (
-	logSizeInBytes   = os.Getenv("LOG_SIZE_IN_BYTES")
-	logRate          = os.Getenv("LOG_RATE")
-	logPath          = "/tmp/tail_file"
-	logGeneratorPath = "/log_generator.py"
-
-	ttl    = os.Getenv("TTL")
-	distro = os.Getenv("DISTRO")
-	vmName = os.Getenv("VM_NAME")
-)
+	logSizeInBytes = os.Getenv("LOG_SIZE_IN_BYTES")
+	logRate        = os.Getenv("LOG_RATE")
 
-//go:embed log_generator.py
-var logGeneratorSource string
+	ttl          = os.Getenv("TTL")
+	distro       = os.Getenv("DISTRO")
+	vmName       = os.Getenv("VM_NAME")
+	logTransport = soak.LogTransport(os.Getenv("LOG_TRANSPORT"))
+
+	project                = os.Getenv("PROJECT")
+	fleetJobFile           = os.Getenv("FLEET_JOB_FILE")
+	leaveRunningOnShutdown = os.Getenv("LEAVE_RUNNING_ON_SHUTDOWN") == "true"
+)
 
 func main() {
 	if err := mainErr(); err != nil {
@@ -89,121 +146,71 @@ func mainErr() error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
 	defer cancel()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Log to stderr.
 	logger := log.Default()
 
+	if err := soak.ReconcileStragglers(ctx, logger, project); err != nil {
+		logger.Printf("could not reconcile straggler VMs, continuing anyway: %v", err)
+	}
+
+	if fleetJobFile != "" {
+		err := fleet.Run(ctx, logger, project, fleetJobFile)
+		// ctx.Err() is DeadlineExceeded once the 60-minute budget above
+		// elapses even for a run that finished exactly as designed, so
+		// only a signal-driven Canceled (see signal.NotifyContext above)
+		// counts as a real interruption worth logging separately here.
+		if errors.Is(ctx.Err(), context.Canceled) {
+			logger.Printf("fleet run interrupted: %v", ctx.Err())
+		}
+		return err
+	}
+
 	parsedTTL, err := time.ParseDuration(ttl)
 	if err != nil {
 		return fmt.Errorf("Could not parse TTL duration %q: %w", ttl, err)
 	}
-
-	// Create the VM.
-	options := gce.VMOptions{
-		Platform:    distro,
-		Name:        vmName,
-		MachineType: "e2-standard-16",
-		Labels: map[string]string{
-			"ttl": strconv.Itoa(int(parsedTTL / time.Minute)),
-		},
-		Metadata: map[string]string{
-			// This is to avoid Windows updates and reboots (b/295165549), and
-			// also to avoid throughput blips when the OS Config agent runs
-			// periodically.
-			"osconfig-disabled-features": "tasks",
-		},
-		ExtraCreateArguments: []string{"--boot-disk-size=4000GB"},
+	parsedLogRate, err := strconv.ParseInt(logRate, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Could not parse LOG_RATE %q: %w", logRate, err)
 	}
-	vm, err := gce.CreateInstance(ctx, logger, options)
+	parsedLogSize, err := strconv.ParseInt(logSizeInBytes, 10, 64)
 	if err != nil {
-		return err
+		return fmt.Errorf("Could not parse LOG_SIZE_IN_BYTES %q: %w", logSizeInBytes, err)
 	}
-	debugLogPath := "/tmp/log_generator.log"
-
-	// Install the Ops Agent with a config telling it to watch logPath,
-	// and debugLogPath for debugging.
-	config := fmt.Sprintf(`logging:
-  receivers:
-    mylog_source:
-      type: files
-      include_paths:
-      - %s
-    generator_debug_logs:
-      type: files
-      include_paths:
-      - %s
-  exporters:
-    google:
-      type: google_cloud_logging
-  service:
-    pipelines:
-      my_pipeline:
-        receivers:
-        - mylog_source
-        - generator_debug_logs
-        exporters: [google]
-`, logPath, debugLogPath)
-	if err := agents.SetupOpsAgent(ctx, logger, vm, config); err != nil {
+	verificationCfg, err := soak.VerificationConfigFromEnv(project)
+	if err != nil {
 		return err
 	}
-
-	// Install Python.
-	// TODO: Consider shipping over a prebuilt binary so that we don't need to
-	// install Python.
-	if gce.IsWindows(vm.Platform) {
-		installPython := `$tempDir = "/tmp"
-mkdir $tempDir
-
-$pythonUrl = 'https://www.python.org/ftp/python/3.11.2/python-3.11.2.exe'
-$pythonInstallerName = $pythonUrl -replace '.*/'
-[Net.ServicePointManager]::SecurityProtocol = [Net.SecurityProtocolType]::Tls12
-$webClient = New-Object System.Net.WebClient
-$webClient.DownloadFile($pythonUrl, "$tempDir\$pythonInstallerName")
-
-$pythonInstallDir = "$env:SystemDrive\Python"
-$pythonPath = "$pythonInstallDir\python.exe"
-Start-Process "$tempDir\$pythonInstallerName" -Wait -ArgumentList "/quiet TargetDir=$pythonInstallDir InstallAllUsers=1"
-`
-		if _, err := gce.RunRemotely(ctx, logger, vm, "", installPython); err != nil {
-			return fmt.Errorf("Could not install Python: %w", err)
-		}
-	} else {
-		if err := agents.InstallPackages(ctx, logger, vm, []string{"python3"}); err != nil {
-			return err
-		}
-	}
-	// Upload log_generator.py.
-	if err := gce.UploadContent(ctx, logger, vm, strings.NewReader(logGeneratorSource), logGeneratorPath); err != nil {
+	resourceSamplingCfg, err := soak.ResourceSamplingConfigFromEnv(project)
+	if err != nil {
 		return err
 	}
 
-	// Start log_generator.py asynchronously.
-	var startLogGenerator string
-	if gce.IsWindows(vm.Platform) {
-		// The best way I've found to start a process asynchronously. One downside
-		// is that standard output and standard error are lost.
-		startLogGenerator = fmt.Sprintf(`Invoke-WmiMethod -ComputerName . -Class Win32_Process -Name Create -ArgumentList "$env:SystemDrive\Python\python.exe %v --log-size-in-bytes=%v --log-rate=%v --log-write-type=file --file-path=%v"`, logGeneratorPath, logSizeInBytes, logRate, logPath)
-	} else {
-		startLogGenerator = fmt.Sprintf(`nohup python3 %v \
-  --log-size-in-bytes="%v" \
-  --log-rate="%v" \
-  --log-write-type=file \
-  --file-path="%v" \
-  &> %v &
-`, logGeneratorPath, logSizeInBytes, logRate, logPath, debugLogPath)
-	}
-	if _, err := gce.RunRemotely(ctx, logger, vm, "", startLogGenerator); err != nil {
-		return err
+	result := soak.RunSoak(ctx, logger, soak.SoakSpec{
+		Distro:                 distro,
+		VMName:                 vmName,
+		TTL:                    parsedTTL,
+		LogRate:                parsedLogRate,
+		LogSizeInBytes:         parsedLogSize,
+		Verification:           &verificationCfg,
+		LeaveRunningOnShutdown: leaveRunningOnShutdown,
+		LogTransport:           logTransport,
+		ResourceSampling:       &resourceSamplingCfg,
+	})
+	if result.Err != nil {
+		return result.Err
 	}
-
-	// Print log_generator log files to debug startup errors.
-	// These log files are unfortunately not available on Windows.
-	if !gce.IsWindows(vm.Platform) {
-		time.Sleep(5 * time.Second)
-
-		if _, err := gce.RunRemotely(ctx, logger, vm, "", "cat "+debugLogPath); err != nil {
-			return err
-		}
+	// ctx.Err() is DeadlineExceeded once the 60-minute budget above
+	// elapses, including for a verified/sampled run that stayed within
+	// MAX_LOSS_PCT for its whole life (soak.runSoak and the delivery
+	// verifier both treat that as the intended way to end). Only a
+	// signal-driven Canceled (see signal.NotifyContext above) means the
+	// run was actually interrupted.
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("run interrupted: %w", ctx.Err())
 	}
 	return nil
 }
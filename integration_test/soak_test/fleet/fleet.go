@@ -0,0 +1,265 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration_test
+
+// Package fleet launches a matrix of soak tests across many VMs at
+// once, instead of the single VM the launcher drives by default. It
+// owns a bounded worker pool, per-VM status reporting, and graceful
+// cancellation so that a failure on one VM (or a Ctrl-C) doesn't strand
+// the rest of the fleet.
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/soak_test/soak"
+)
+
+// sharedConfig is the subset of SoakSpec that applies uniformly to every
+// cell in the matrix, built once from the same environment variables
+// the launcher's single-VM mode reads (see cmd/launcher's doc comment).
+// Only Distro/LogRate/LogSizeInBytes vary per cell.
+type sharedConfig struct {
+	leaveRunningOnShutdown bool
+	logTransport           soak.LogTransport
+	verification           soak.VerificationConfig
+	resourceSampling       soak.ResourceSamplingConfig
+}
+
+func sharedConfigFromEnv(project string) (sharedConfig, error) {
+	verificationCfg, err := soak.VerificationConfigFromEnv(project)
+	if err != nil {
+		return sharedConfig{}, err
+	}
+	resourceSamplingCfg, err := soak.ResourceSamplingConfigFromEnv(project)
+	if err != nil {
+		return sharedConfig{}, err
+	}
+	return sharedConfig{
+		leaveRunningOnShutdown: os.Getenv("LEAVE_RUNNING_ON_SHUTDOWN") == "true",
+		logTransport:           soak.LogTransport(os.Getenv("LOG_TRANSPORT")),
+		verification:           verificationCfg,
+		resourceSampling:       resourceSamplingCfg,
+	}, nil
+}
+
+// defaultConcurrency bounds how many VMs are soak-tested at once, so
+// that a large job file doesn't exhaust project quota.
+const defaultConcurrency = 10
+
+// Job describes the matrix of soak tests to run, read from a YAML or
+// JSON job file.
+type Job struct {
+	// Concurrency bounds how many VMs run at once. Defaults to
+	// defaultConcurrency if zero.
+	Concurrency int `yaml:"concurrency" json:"concurrency"`
+	// TTL applies to every VM in the matrix.
+	TTL string `yaml:"ttl" json:"ttl"`
+	// SummaryFile, if set, receives a JSON summary of the whole fleet run
+	// once every cell has finished.
+	SummaryFile string `yaml:"summary_file" json:"summary_file"`
+	// Matrix is the list of (distro, log_rate, log_size) cells to run.
+	Matrix []Cell `yaml:"matrix" json:"matrix"`
+}
+
+// Cell is one (distro, log_rate, log_size) tuple in the matrix.
+type Cell struct {
+	Distro         string `yaml:"distro" json:"distro"`
+	LogRate        int64  `yaml:"log_rate" json:"log_rate"`
+	LogSizeInBytes int64  `yaml:"log_size_in_bytes" json:"log_size_in_bytes"`
+}
+
+// status is emitted as a JSON line to stdout every time a cell's state
+// changes, so that a human or a CI job can tail progress live.
+type status struct {
+	Cell  Cell   `json:"cell"`
+	State string `json:"state"` // "starting", "succeeded", "failed"
+	Error string `json:"error,omitempty"`
+}
+
+// cellResult is one row of the final summary.
+type cellResult struct {
+	Cell Cell `json:"cell"`
+	// ObservedLogsPerSec is the entries/sec actually confirmed delivered
+	// over the run, or 0 if verification was not enabled.
+	ObservedLogsPerSec float64 `json:"observed_logs_per_sec"`
+	LossPct            float64 `json:"loss_pct"`
+	Error              string  `json:"error,omitempty"`
+}
+
+// summary is written to Job.SummaryFile once every cell has finished.
+type summary struct {
+	Results []cellResult `json:"results"`
+}
+
+// Run reads the job file at path and soak-tests every cell in its
+// matrix, bounded by Job.Concurrency VMs at a time. Verification,
+// LOG_TRANSPORT, resource sampling, and LEAVE_RUNNING_ON_SHUTDOWN are
+// read from the environment once, the same way the launcher's
+// single-VM mode reads them, and applied uniformly to every cell.
+// Ctrl-C (or an external SIGTERM) cancels ctx, which causes every
+// in-flight VM to be deleted via gce.DeleteInstance (see soak.RunSoak)
+// before Run returns, unless LEAVE_RUNNING_ON_SHUTDOWN is set;
+// gce.CleanupKeysOrDie runs afterwards, deferred in the launcher's main.
+// A failure on one cell does not prevent the rest of the matrix from
+// running. Run returns an error if the job file could not be read or
+// parsed, if the shared environment configuration or the job's TTL is
+// invalid, if pubsub verification is requested for more than one cell,
+// or if any cell failed.
+func Run(ctx context.Context, logger *log.Logger, project, jobFilePath string) error {
+	job, err := loadJob(jobFilePath)
+	if err != nil {
+		return err
+	}
+	shared, err := sharedConfigFromEnv(project)
+	if err != nil {
+		return err
+	}
+	// A Pub/Sub subscription load-balances messages across whichever
+	// Receive call happens to pull them, rather than broadcasting; two
+	// concurrent cells sharing one subscription via VerificationConfig
+	// would silently steal and ack each other's entries. Until each cell
+	// gets its own topic/subscription, only allow pubsub verification
+	// for single-cell fleet runs.
+	if shared.verification.Enabled && shared.verification.Mode == "pubsub" && len(job.Matrix) > 1 {
+		return fmt.Errorf("VERIFICATION_MODE=pubsub is not supported for fleet runs with more than one matrix cell (got %d)", len(job.Matrix))
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	concurrency := job.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	ttl, err := time.ParseDuration(job.TTL)
+	if err != nil {
+		return fmt.Errorf("could not parse fleet TTL %q: %w", job.TTL, err)
+	}
+
+	results := make([]cellResult, len(job.Matrix))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex // guards stdout status lines
+
+	for i, cell := range job.Matrix {
+		i, cell := i, cell
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = runCell(ctx, logger, &mu, cell, ttl, shared)
+		}()
+	}
+	wg.Wait()
+
+	var failures int
+	for _, r := range results {
+		if r.Error != "" {
+			failures++
+		}
+	}
+
+	if job.SummaryFile != "" {
+		if err := writeSummary(job.SummaryFile, results); err != nil {
+			logger.Printf("fleet: could not write summary file %q: %v", job.SummaryFile, err)
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("fleet: %d of %d cells failed", failures, len(results))
+	}
+	return nil
+}
+
+func runCell(ctx context.Context, logger *log.Logger, mu *sync.Mutex, cell Cell, ttl time.Duration, shared sharedConfig) cellResult {
+	emit(mu, status{Cell: cell, State: "starting"})
+
+	result := soak.RunSoak(ctx, logger, soak.SoakSpec{
+		Distro:                 cell.Distro,
+		TTL:                    ttl,
+		LogRate:                cell.LogRate,
+		LogSizeInBytes:         cell.LogSizeInBytes,
+		Verification:           &shared.verification,
+		LeaveRunningOnShutdown: shared.leaveRunningOnShutdown,
+		LogTransport:           shared.logTransport,
+		ResourceSampling:       &shared.resourceSampling,
+	})
+
+	cr := cellResult{Cell: cell, LossPct: result.LossPct, ObservedLogsPerSec: result.ObservedLogsPerSec}
+	switch {
+	case result.Err != nil:
+		cr.Error = result.Err.Error()
+	case errors.Is(ctx.Err(), context.Canceled):
+		// A preempted cell's result.Err already covers that case (see
+		// soak.RunSoak); this only catches a user-initiated shutdown
+		// (Ctrl-C/SIGTERM), which RunSoak otherwise treats the same as a
+		// verified run that completed its whole life normally. Exclude
+		// DeadlineExceeded: the 60-minute budget in main elapsing is also
+		// how a healthy run ends, not an interruption.
+		cr.Error = fmt.Sprintf("run interrupted: %v", ctx.Err())
+	}
+	if cr.Error != "" {
+		emit(mu, status{Cell: cell, State: "failed", Error: cr.Error})
+	} else {
+		emit(mu, status{Cell: cell, State: "succeeded"})
+	}
+	return cr
+}
+
+func emit(mu *sync.Mutex, s status) {
+	mu.Lock()
+	defer mu.Unlock()
+	line, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	fmt.Println(string(line))
+}
+
+func loadJob(path string) (Job, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Job{}, fmt.Errorf("could not read fleet job file %q: %w", path, err)
+	}
+	var job Job
+	if err := yaml.Unmarshal(data, &job); err != nil {
+		return Job{}, fmt.Errorf("could not parse fleet job file %q as YAML or JSON: %w", path, err)
+	}
+	if len(job.Matrix) == 0 {
+		return Job{}, fmt.Errorf("fleet job file %q has an empty matrix", path)
+	}
+	return job, nil
+}
+
+func writeSummary(path string, results []cellResult) error {
+	data, err := json.MarshalIndent(summary{Results: results}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration_test
+
+package soak
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/agents"
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/gce"
+)
+
+// startLogGenerator installs whatever log_generator.py needs (Python,
+// or a Docker daemon for TransportDockerJSON) and starts it
+// asynchronously so that it keeps running for the life of the soak.
+func startLogGenerator(ctx context.Context, logger *log.Logger, vm *gce.VM, transport LogTransport, spec SoakSpec, logPath, debugLogPath, runID string) error {
+	if transport == TransportEventLog {
+		return startEventLogGenerator(ctx, logger, vm, spec, runID)
+	}
+	if transport == TransportDockerJSON {
+		return startDockerLogGenerator(ctx, logger, vm, spec, runID, debugLogPath)
+	}
+	return startPythonLogGenerator(ctx, logger, vm, transport, spec, logPath, debugLogPath, runID)
+}
+
+// startPythonLogGenerator is the original files/syslog/tcp/fluent_forward
+// path: install Python directly on the VM and run log_generator.py
+// there, writing to logPath (files) or transportPort (network
+// transports).
+func startPythonLogGenerator(ctx context.Context, logger *log.Logger, vm *gce.VM, transport LogTransport, spec SoakSpec, logPath, debugLogPath, runID string) error {
+	// Install Python.
+	// TODO: Consider shipping over a prebuilt binary so that we don't need to
+	// install Python.
+	if gce.IsWindows(vm.Platform) {
+		installPython := `$tempDir = "/tmp"
+mkdir $tempDir
+
+$pythonUrl = 'https://www.python.org/ftp/python/3.11.2/python-3.11.2.exe'
+$pythonInstallerName = $pythonUrl -replace '.*/'
+[Net.ServicePointManager]::SecurityProtocol = [Net.SecurityProtocolType]::Tls12
+$webClient = New-Object System.Net.WebClient
+$webClient.DownloadFile($pythonUrl, "$tempDir\$pythonInstallerName")
+
+$pythonInstallDir = "$env:SystemDrive\Python"
+$pythonPath = "$pythonInstallDir\python.exe"
+Start-Process "$tempDir\$pythonInstallerName" -Wait -ArgumentList "/quiet TargetDir=$pythonInstallDir InstallAllUsers=1"
+`
+		if _, err := gce.RunRemotely(ctx, logger, vm, "", installPython); err != nil {
+			return fmt.Errorf("Could not install Python: %w", err)
+		}
+	} else if err := agents.InstallPackages(ctx, logger, vm, []string{"python3"}); err != nil {
+		return err
+	}
+
+	// Upload log_generator.py.
+	if err := gce.UploadContent(ctx, logger, vm, strings.NewReader(logGeneratorSource), logGeneratorPath); err != nil {
+		return err
+	}
+
+	writeType := logGeneratorWriteType(transport)
+	target := logPath
+	if usesNetworkTransport(transport) {
+		target = fmt.Sprintf("127.0.0.1:%d", transportPort)
+	}
+
+	// Start log_generator.py asynchronously.
+	var startLogGenerator string
+	if gce.IsWindows(vm.Platform) {
+		// The best way I've found to start a process asynchronously. One downside
+		// is that standard output and standard error are lost.
+		startLogGenerator = fmt.Sprintf(`Invoke-WmiMethod -ComputerName . -Class Win32_Process -Name Create -ArgumentList "$env:SystemDrive\Python\python.exe %v --log-size-in-bytes=%v --log-rate=%v --log-write-type=%v --file-path=%v --run-id=%v"`, logGeneratorPath, spec.LogSizeInBytes, spec.LogRate, writeType, target, runID)
+	} else {
+		startLogGenerator = fmt.Sprintf(`nohup python3 %v \
+  --log-size-in-bytes="%v" \
+  --log-rate="%v" \
+  --log-write-type=%v \
+  --file-path="%v" \
+  --run-id="%v" \
+  &> %v &
+`, logGeneratorPath, spec.LogSizeInBytes, spec.LogRate, writeType, target, runID, debugLogPath)
+	}
+	if _, err := gce.RunRemotely(ctx, logger, vm, "", startLogGenerator); err != nil {
+		return err
+	}
+
+	// Print log_generator log files to debug startup errors.
+	// These log files are unfortunately not available on Windows.
+	if !gce.IsWindows(vm.Platform) {
+		time.Sleep(5 * time.Second)
+
+		if _, err := gce.RunRemotely(ctx, logger, vm, "", "cat "+debugLogPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startEventLogGenerator writes directly to the Windows Event Log
+// instead of running log_generator.py, since the generator has no
+// Windows Event Log support of its own. The generator script is passed
+// to powershell.exe as -EncodedCommand, which sidesteps the quoting
+// nightmare of nesting PowerShell inside the WMI ArgumentList string.
+func startEventLogGenerator(ctx context.Context, logger *log.Logger, vm *gce.VM, spec SoakSpec, runID string) error {
+	registerSource := `New-EventLog -LogName Application -Source OpsAgentSoakTest -ErrorAction SilentlyContinue`
+	if _, err := gce.RunRemotely(ctx, logger, vm, "", registerSource); err != nil {
+		return fmt.Errorf("could not register Windows Event Log source: %w", err)
+	}
+
+	script := fmt.Sprintf(`$seq = 0
+$intervalMs = [math]::Round(1000 / %v)
+$padding = 'x' * %v
+while ($true) {
+  $generatedTimestamp = [DateTimeOffset]::UtcNow.ToUnixTimeMilliseconds() / 1000.0
+  $msg = '{"run_id":"%v","seq":' + $seq + ',"generated_timestamp":' + $generatedTimestamp + ',"padding":"' + $padding + '"}'
+  Write-EventLog -LogName Application -Source OpsAgentSoakTest -EventId 1 -Message $msg
+  $seq++
+  Start-Sleep -Milliseconds $intervalMs
+}`, spec.LogRate, spec.LogSizeInBytes, runID)
+
+	startGenerator := fmt.Sprintf(`Invoke-WmiMethod -ComputerName . -Class Win32_Process -Name Create -ArgumentList "powershell.exe -EncodedCommand %v"`, encodePowerShellCommand(script))
+	if _, err := gce.RunRemotely(ctx, logger, vm, "", startGenerator); err != nil {
+		return err
+	}
+	return nil
+}
+
+// encodePowerShellCommand encodes script the way powershell.exe
+// -EncodedCommand expects: UTF-16LE, then base64.
+func encodePowerShellCommand(script string) string {
+	var buf []byte
+	for _, u := range utf16.Encode([]rune(script)) {
+		buf = append(buf, byte(u), byte(u>>8))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// startDockerLogGenerator installs Docker, then runs log_generator.py
+// inside a container writing to stdout, so delivery is exercised
+// through Docker's own json-file logging driver (the path the files
+// receiver normally reads) rather than a host-side file the generator
+// writes directly.
+func startDockerLogGenerator(ctx context.Context, logger *log.Logger, vm *gce.VM, spec SoakSpec, runID, debugLogPath string) error {
+	if gce.IsWindows(vm.Platform) {
+		return fmt.Errorf("LOG_TRANSPORT=%s is not supported on Windows", TransportDockerJSON)
+	}
+	installDocker := `curl -fsSL https://get.docker.com | sh`
+	if _, err := gce.RunRemotely(ctx, logger, vm, "", installDocker); err != nil {
+		return fmt.Errorf("could not install Docker: %w", err)
+	}
+	if err := gce.UploadContent(ctx, logger, vm, strings.NewReader(logGeneratorSource), logGeneratorPath); err != nil {
+		return err
+	}
+
+	startContainer := fmt.Sprintf(`nohup docker run --rm \
+  -v %v:/log_generator.py:ro \
+  python:3-slim \
+  python3 /log_generator.py \
+    --log-size-in-bytes="%v" \
+    --log-rate="%v" \
+    --log-write-type=file \
+    --file-path=/dev/stdout \
+    --run-id="%v" \
+  &> %v &
+`, logGeneratorPath, spec.LogSizeInBytes, spec.LogRate, runID, debugLogPath)
+	if _, err := gce.RunRemotely(ctx, logger, vm, "", startContainer); err != nil {
+		return err
+	}
+	return nil
+}
+
+// progressSeqPattern matches the {"progress_seq": N} lines
+// log_generator.py prints to stdout once a second.
+var progressSeqPattern = regexp.MustCompile(`"progress_seq": *([0-9]+)`)
+
+// generatedCounter returns a func reporting how many entries
+// log_generator.py has actually generated so far, by reading its
+// latest {"progress_seq": N} line back out of debugLogPath, rather
+// than assuming a perfectly constant spec.LogRate from whenever the
+// caller happened to start watching.
+//
+// On a platform where debugLogPath isn't actually populated with the
+// generator's stdout -- Windows, where the WMI process creation used
+// to start it loses stdout/stderr entirely, and TransportEventLog,
+// which doesn't run log_generator.py at all -- this falls back to the
+// same elapsed-time estimate used before this function existed.
+func generatedCounter(vm *gce.VM, logger *log.Logger, debugLogPath string, spec SoakSpec) func(ctx context.Context) (int64, error) {
+	if gce.IsWindows(vm.Platform) {
+		startedAt := time.Now()
+		return func(ctx context.Context) (int64, error) {
+			return int64(time.Since(startedAt).Seconds()) * spec.LogRate, nil
+		}
+	}
+	return func(ctx context.Context) (int64, error) {
+		output, err := gce.RunRemotely(ctx, logger, vm, "", fmt.Sprintf(`grep -o '"progress_seq": *[0-9]*' %s | tail -n1`, debugLogPath))
+		if err != nil {
+			return 0, fmt.Errorf("could not read generator progress from %s: %w", debugLogPath, err)
+		}
+		match := progressSeqPattern.FindStringSubmatch(output.Stdout)
+		if match == nil {
+			// Nothing reported yet, e.g. still within the generator's
+			// first progress-report interval.
+			return 0, nil
+		}
+		seq, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse generator progress %q: %w", match[1], err)
+		}
+		return seq, nil
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration_test
+
+package soak
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/gce"
+)
+
+// preemptionPollInterval is how often watchForPreemption checks whether
+// the VM is still running.
+const preemptionPollInterval = 30 * time.Second
+
+// watchForPreemption starts a goroutine that polls vm's status every
+// preemptionPollInterval. If it notices the VM is no longer running, it
+// calls cancel (so the rest of runSoak unwinds the same way it would
+// for a user-initiated shutdown) and records that preemption, not the
+// user, was the cause. The returned func reports that; it's consulted
+// by runSoak's shutdown path to report the two cases distinctly.
+//
+// The goroutine exits once ctx is done, since at that point the run is
+// ending for some reason and there's nothing further to watch for.
+func watchForPreemption(ctx context.Context, cancel context.CancelFunc, logger *log.Logger, vm *gce.VM) func() bool {
+	var detected atomic.Bool
+
+	go func() {
+		ticker := time.NewTicker(preemptionPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				running, err := gce.IsInstanceRunning(ctx, logger, vm)
+				if err != nil {
+					logger.Printf("soak: could not poll status of VM %s: %v", vm.Name, err)
+					continue
+				}
+				if !running {
+					detected.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return detected.Load
+}
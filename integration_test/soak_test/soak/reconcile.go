@@ -0,0 +1,72 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration_test
+
+package soak
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/gce"
+)
+
+// ReconcileStragglers lists every VM in project labeled managed-by this
+// package (i.e. created by a previous, possibly crashed, soak run) and
+// deletes the ones whose ttl label has already elapsed. It solves the
+// orphaned-VM problem that would otherwise accumulate when a soak run
+// dies mid-flight instead of reaching RunSoak's own cleanup path.
+//
+// Call this before creating a new VM, not concurrently with a run that
+// might still legitimately own one of the listed instances.
+func ReconcileStragglers(ctx context.Context, logger *log.Logger, project string) error {
+	instances, err := gce.ListInstances(ctx, logger, project, managedByLabel)
+	if err != nil {
+		return fmt.Errorf("could not list existing soak-test VMs: %w", err)
+	}
+
+	for _, instance := range instances {
+		elapsed, err := stragglerTTLElapsed(instance)
+		if err != nil {
+			logger.Printf("soak: could not determine ttl for straggler VM %s, leaving it alone: %v", instance.Name, err)
+			continue
+		}
+		if !elapsed {
+			continue
+		}
+		logger.Printf("soak: reconciler deleting straggler VM %s (ttl elapsed)", instance.Name)
+		if err := gce.DeleteInstance(ctx, logger, instance); err != nil {
+			logger.Printf("soak: could not delete straggler VM %s: %v", instance.Name, err)
+		}
+	}
+	return nil
+}
+
+// stragglerTTLElapsed reports whether instance's ttl label (in minutes,
+// the same format RunSoak writes) has elapsed since it was created.
+func stragglerTTLElapsed(instance *gce.VM) (bool, error) {
+	ttlMinutes, ok := instance.Labels["ttl"]
+	if !ok {
+		return false, fmt.Errorf("VM %s has no ttl label", instance.Name)
+	}
+	minutes, err := strconv.Atoi(ttlMinutes)
+	if err != nil {
+		return false, fmt.Errorf("VM %s has unparseable ttl label %q: %w", instance.Name, ttlMinutes, err)
+	}
+	return time.Since(instance.CreationTimestamp) > time.Duration(minutes)*time.Minute, nil
+}
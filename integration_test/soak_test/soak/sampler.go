@@ -0,0 +1,442 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration_test
+
+package soak
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/gce"
+)
+
+// sampledProcesses are the Ops Agent binaries whose resource usage is
+// tracked for the life of the soak, by the name ps/Get-Process sees.
+var sampledProcesses = []string{"google-cloud-ops-agent-fluent-bit", "otelopscol"}
+
+// ResourceSamplingConfig controls the optional resource-usage sampler.
+// See the launcher's package doc comment for the environment variables
+// it's built from.
+type ResourceSamplingConfig struct {
+	Enabled bool
+	// Project is the GCP project custom metrics are written to.
+	Project string
+	// Interval is how often the sampler polls the VM.
+	Interval time.Duration
+	// CSVPath is where raw samples are appended on the machine running
+	// the launcher (not the soak VM).
+	CSVPath string
+	// BaselineFile, if set, is a JSON file mapping a matrix cell key (see
+	// matrixCell.key) to the percentile summary RunSoak should be compared
+	// against at the end of the run.
+	BaselineFile string
+}
+
+// ResourceSamplingConfigFromEnv builds a ResourceSamplingConfig from
+// the RESOURCE_SAMPLING_* environment variables.
+func ResourceSamplingConfigFromEnv(project string) (ResourceSamplingConfig, error) {
+	cfg := ResourceSamplingConfig{
+		Enabled:      getenvBool("RESOURCE_SAMPLING_ENABLED", false),
+		Project:      project,
+		CSVPath:      getenvDefault("RESOURCE_SAMPLING_CSV", "/tmp/ops_agent_resource_samples.csv"),
+		BaselineFile: getenvDefault("RESOURCE_SAMPLING_BASELINE_FILE", ""),
+	}
+	intervalStr := getenvDefault("RESOURCE_SAMPLING_INTERVAL", "30s")
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil {
+		return ResourceSamplingConfig{}, fmt.Errorf("could not parse RESOURCE_SAMPLING_INTERVAL %q: %w", intervalStr, err)
+	}
+	cfg.Interval = interval
+	return cfg, nil
+}
+
+// resourceSample is one process's resource usage at one point in time.
+type resourceSample struct {
+	Timestamp  time.Time
+	Process    string
+	CPUPct     float64
+	RSSBytes   int64
+	OpenFDs    int64
+	DiskReadB  int64
+	DiskWriteB int64
+}
+
+// percentileSummary is the end-of-run summary for one process, used
+// both in the printed report and for baseline regression checks.
+type percentileSummary struct {
+	Process     string  `json:"process"`
+	P50CPUPct   float64 `json:"p50_cpu_pct"`
+	P95CPUPct   float64 `json:"p95_cpu_pct"`
+	P50RSSBytes int64   `json:"p50_rss_bytes"`
+	P95RSSBytes int64   `json:"p95_rss_bytes"`
+}
+
+// baselineRegressionThreshold is how much worse (as a fraction, e.g.
+// 0.2 = 20%) a run's p95 CPU or RSS may be versus its baseline before
+// it's flagged as a regression.
+const baselineRegressionThreshold = 0.2
+
+// resourceSampler streams ps/Get-Counter samples from a soak VM to a
+// local CSV file for the life of the run, and reports percentile
+// summaries (with an optional baseline regression check) once the run
+// ends. It turns the soak from a "does it crash?" check into a
+// performance-regression detector.
+type resourceSampler struct {
+	cfg    ResourceSamplingConfig
+	vm     *gce.VM
+	logger *log.Logger
+	cell   matrixCell
+
+	mu      sync.Mutex
+	samples []resourceSample
+}
+
+// matrixCell identifies a soak configuration for baseline lookups,
+// mirroring fleet.Cell without creating an import cycle.
+type matrixCell struct {
+	Distro         string `json:"distro"`
+	LogRate        int64  `json:"log_rate"`
+	LogSizeInBytes int64  `json:"log_size_in_bytes"`
+}
+
+func (c matrixCell) key() string {
+	return fmt.Sprintf("%s/%d/%d", c.Distro, c.LogRate, c.LogSizeInBytes)
+}
+
+func newResourceSampler(cfg ResourceSamplingConfig, vm *gce.VM, logger *log.Logger, cell matrixCell) *resourceSampler {
+	return &resourceSampler{cfg: cfg, vm: vm, logger: logger, cell: cell}
+}
+
+// run polls the VM every cfg.Interval until ctx is done, appending each
+// sample to cfg.CSVPath and (if cfg.Project is set) to a Cloud
+// Monitoring custom metric.
+func (s *resourceSampler) run(ctx context.Context) {
+	csvFile, err := os.OpenFile(s.cfg.CSVPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		s.logger.Printf("sampler: could not open %q, samples will only be kept in memory: %v", s.cfg.CSVPath, err)
+		csvFile = nil
+	} else {
+		defer csvFile.Close()
+	}
+	var csvWriter *csv.Writer
+	if csvFile != nil {
+		csvWriter = csv.NewWriter(csvFile)
+		defer csvWriter.Flush()
+	}
+
+	var monitoringClient *monitoring.MetricClient
+	if s.cfg.Project != "" {
+		if c, err := monitoring.NewMetricClient(ctx); err != nil {
+			s.logger.Printf("sampler: could not create Cloud Monitoring client, skipping custom metrics: %v", err)
+		} else {
+			monitoringClient = c
+			defer monitoringClient.Close()
+		}
+	}
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			samples, err := s.collect(ctx)
+			if err != nil {
+				s.logger.Printf("sampler: failed to collect resource samples: %v", err)
+				continue
+			}
+			s.mu.Lock()
+			s.samples = append(s.samples, samples...)
+			s.mu.Unlock()
+
+			for _, sample := range samples {
+				if csvWriter != nil {
+					writeCSVRow(csvWriter, sample)
+				}
+				if monitoringClient != nil {
+					if err := writeMonitoringPoint(ctx, monitoringClient, s.cfg.Project, s.vm.Name, sample); err != nil {
+						s.logger.Printf("sampler: failed to write custom metric for %s: %v", sample.Process, err)
+					}
+				}
+			}
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+		}
+	}
+}
+
+// collect runs a single remote collection pass across sampledProcesses.
+func (s *resourceSampler) collect(ctx context.Context) ([]resourceSample, error) {
+	var cmd string
+	if gce.IsWindows(s.vm.Platform) {
+		cmd = windowsSampleCommand(sampledProcesses)
+	} else {
+		cmd = linuxSampleCommand(sampledProcesses)
+	}
+	output, err := gce.RunRemotely(ctx, s.logger, s.vm, "", cmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseSampleOutput(output.Stdout, time.Now())
+}
+
+// summarize computes a percentileSummary per sampled process from
+// everything collected so far.
+func (s *resourceSampler) summarize() []percentileSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byProcess := map[string][]resourceSample{}
+	for _, sample := range s.samples {
+		byProcess[sample.Process] = append(byProcess[sample.Process], sample)
+	}
+
+	var summaries []percentileSummary
+	for _, process := range sampledProcesses {
+		samples := byProcess[process]
+		if len(samples) == 0 {
+			continue
+		}
+		cpu := make([]float64, len(samples))
+		rss := make([]int64, len(samples))
+		for i, sample := range samples {
+			cpu[i] = sample.CPUPct
+			rss[i] = sample.RSSBytes
+		}
+		sort.Float64s(cpu)
+		sort.Slice(rss, func(i, j int) bool { return rss[i] < rss[j] })
+		summaries = append(summaries, percentileSummary{
+			Process:     process,
+			P50CPUPct:   percentile(cpu, 0.50),
+			P95CPUPct:   percentile(cpu, 0.95),
+			P50RSSBytes: int64Percentile(rss, 0.50),
+			P95RSSBytes: int64Percentile(rss, 0.95),
+		})
+	}
+	return summaries
+}
+
+// report logs the final percentile summaries and, if cfg.BaselineFile
+// is set, compares them against the stored baseline for s.cell.
+func (s *resourceSampler) report() {
+	summaries := s.summarize()
+	for _, summary := range summaries {
+		s.logger.Printf("sampler: %s p50_cpu=%.1f%% p95_cpu=%.1f%% p50_rss=%dB p95_rss=%dB",
+			summary.Process, summary.P50CPUPct, summary.P95CPUPct, summary.P50RSSBytes, summary.P95RSSBytes)
+	}
+
+	if s.cfg.BaselineFile == "" {
+		return
+	}
+	baselines, err := loadBaselines(s.cfg.BaselineFile)
+	if err != nil {
+		s.logger.Printf("sampler: could not load baseline file %q: %v", s.cfg.BaselineFile, err)
+		return
+	}
+	baseline, ok := baselines[s.cell.key()]
+	if !ok {
+		s.logger.Printf("sampler: no baseline recorded yet for %s", s.cell.key())
+		return
+	}
+	for _, summary := range summaries {
+		var prior *percentileSummary
+		for i := range baseline {
+			if baseline[i].Process == summary.Process {
+				prior = &baseline[i]
+				break
+			}
+		}
+		if prior == nil {
+			continue
+		}
+		if regressed, pct := regressionPct(prior.P95CPUPct, summary.P95CPUPct); regressed {
+			s.logger.Printf("sampler: REGRESSION %s p95 CPU up %.0f%% vs baseline (%.1f%% -> %.1f%%)",
+				summary.Process, pct, prior.P95CPUPct, summary.P95CPUPct)
+		}
+		if regressed, pct := regressionPct(float64(prior.P95RSSBytes), float64(summary.P95RSSBytes)); regressed {
+			s.logger.Printf("sampler: REGRESSION %s p95 RSS up %.0f%% vs baseline (%dB -> %dB)",
+				summary.Process, pct, prior.P95RSSBytes, summary.P95RSSBytes)
+		}
+	}
+}
+
+func regressionPct(baseline, current float64) (bool, float64) {
+	if baseline <= 0 {
+		return false, 0
+	}
+	delta := (current - baseline) / baseline
+	return delta > baselineRegressionThreshold, delta * 100
+}
+
+func loadBaselines(path string) (map[string][]percentileSummary, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string][]percentileSummary{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var baselines map[string][]percentileSummary
+	if err := json.Unmarshal(data, &baselines); err != nil {
+		return nil, err
+	}
+	return baselines, nil
+}
+
+func writeCSVRow(w *csv.Writer, sample resourceSample) {
+	_ = w.Write([]string{
+		sample.Timestamp.Format(time.RFC3339),
+		sample.Process,
+		strconv.FormatFloat(sample.CPUPct, 'f', 2, 64),
+		strconv.FormatInt(sample.RSSBytes, 10),
+		strconv.FormatInt(sample.OpenFDs, 10),
+		strconv.FormatInt(sample.DiskReadB, 10),
+		strconv.FormatInt(sample.DiskWriteB, 10),
+	})
+}
+
+// writeMonitoringPoint writes sample's CPU percentage as a Cloud
+// Monitoring custom metric, labeled by process and VM name.
+func writeMonitoringPoint(ctx context.Context, client *monitoring.MetricClient, project, vmName string, sample resourceSample) error {
+	now := timestamppb.New(sample.Timestamp)
+	req := &monitoringpb.CreateTimeSeriesRequest{
+		Name: fmt.Sprintf("projects/%s", project),
+		TimeSeries: []*monitoringpb.TimeSeries{
+			{
+				Metric: &metric.Metric{
+					Type: "custom.googleapis.com/ops_agent_soak/cpu_pct",
+					Labels: map[string]string{
+						"process": sample.Process,
+						"vm_name": vmName,
+					},
+				},
+				Resource: &monitoredres.MonitoredResource{
+					Type:   "generic_task",
+					Labels: map[string]string{"project_id": project, "location": "global", "namespace": "ops-agent-soak-test", "job": vmName, "task_id": sample.Process},
+				},
+				Points: []*monitoringpb.Point{
+					{
+						Interval: &monitoringpb.TimeInterval{EndTime: now},
+						Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: sample.CPUPct}},
+					},
+				},
+			},
+		},
+	}
+	return client.CreateTimeSeries(ctx, req)
+}
+
+// linuxSampleCommand builds a shell command that prints one CSV line
+// per process in processes: "name,cpu_pct,rss_bytes,open_fds,read_bytes,write_bytes".
+// A process that isn't running is skipped rather than erroring, since
+// that's a normal state (e.g. the collector restarting).
+func linuxSampleCommand(processes []string) string {
+	var b strings.Builder
+	b.WriteString("set -e\n")
+	for _, p := range processes {
+		fmt.Fprintf(&b, `pid=$(pgrep -f %s | head -n1)
+if [ -n "$pid" ] && cpu_rss=$(ps -o %%cpu=,rss= -p "$pid" 2>/dev/null); then
+  cpu=$(echo "$cpu_rss" | awk '{print $1}')
+  rss_kb=$(echo "$cpu_rss" | awk '{print $2}')
+  fds=$(ls /proc/"$pid"/fd 2>/dev/null | wc -l)
+  read_bytes=$(awk '/read_bytes/{print $2}' /proc/"$pid"/io 2>/dev/null || echo 0)
+  write_bytes=$(awk '/write_bytes/{print $2}' /proc/"$pid"/io 2>/dev/null || echo 0)
+  echo "%s,$cpu,$((rss_kb * 1024)),$fds,$read_bytes,$write_bytes"
+fi
+`, shellQuote(p), p)
+	}
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// windowsSampleCommand builds a PowerShell command producing the same
+// CSV shape as linuxSampleCommand, via Get-Process/Get-Counter. Disk
+// I/O and fd counts (handle counts stand in for fds on Windows) are
+// best-effort.
+func windowsSampleCommand(processes []string) string {
+	var b strings.Builder
+	for _, p := range processes {
+		fmt.Fprintf(&b, `$proc = Get-Process -Name %q -ErrorAction SilentlyContinue | Select-Object -First 1
+if ($proc) {
+  $cpuCounter = (Get-Counter "\Process($($proc.ProcessName))\%% Processor Time").CounterSamples[0].CookedValue
+  Write-Output ("%s,{0},{1},{2},{3},{4}" -f $cpuCounter, $proc.WorkingSet64, $proc.HandleCount, $proc.ReadOperationCount, $proc.WriteOperationCount)
+}
+`, p, p)
+	}
+	return b.String()
+}
+
+// parseSampleOutput parses the CSV lines linuxSampleCommand /
+// windowsSampleCommand print into resourceSamples timestamped at t.
+func parseSampleOutput(output string, t time.Time) ([]resourceSample, error) {
+	var samples []resourceSample
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 6 {
+			continue
+		}
+		cpu, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		rss, _ := strconv.ParseInt(fields[2], 10, 64)
+		fds, _ := strconv.ParseInt(fields[3], 10, 64)
+		readBytes, _ := strconv.ParseInt(fields[4], 10, 64)
+		writeBytes, _ := strconv.ParseInt(fields[5], 10, 64)
+		samples = append(samples, resourceSample{
+			Timestamp:  t,
+			Process:    fields[0],
+			CPUPct:     cpu,
+			RSSBytes:   rss,
+			OpenFDs:    fds,
+			DiskReadB:  readBytes,
+			DiskWriteB: writeBytes,
+		})
+	}
+	return samples, nil
+}
+
+func int64Percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx]
+}
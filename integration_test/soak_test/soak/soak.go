@@ -0,0 +1,260 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration_test
+
+// Package soak runs a single soak test: it launches a VM, installs the
+// Ops Agent and a log generator on it, and optionally verifies that the
+// generated logs made it to Cloud Logging. The launcher command drives
+// this package for a single VM specified by environment variables; the
+// fleet package drives it concurrently for many VMs at once.
+package soak
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/agents"
+	"github.com/GoogleCloudPlatform/ops-agent/integration_test/gce"
+)
+
+const logGeneratorPath = "/log_generator.py"
+
+// managedByLabel is stamped onto every VM this package creates, so that
+// ReconcileStragglers can find them later without picking up unrelated
+// instances in the project.
+const managedByLabel = "ops-agent-soak-test"
+
+//go:embed log_generator.py
+var logGeneratorSource string
+
+// SoakSpec describes one soak test to run against a single VM. It is
+// the set of knobs that used to be read directly from the environment
+// by the launcher's main function.
+type SoakSpec struct {
+	// Distro is the GCE image family name to run, e.g. "debian-11".
+	Distro string
+	// VMName is the name of the VM to spawn. If empty, a random name is
+	// generated by gce.CreateInstance.
+	VMName string
+	// TTL is how long to keep the VM alive.
+	TTL time.Duration
+	// LogRate is how many log entries per second the generator sends.
+	LogRate int64
+	// LogSizeInBytes is how many bytes each log entry should be.
+	LogSizeInBytes int64
+
+	// Verification, if non-nil, turns on delivery verification for this
+	// run. See VerificationConfig for details.
+	Verification *VerificationConfig
+
+	// LeaveRunningOnShutdown, if true, skips deleting the VM when the run
+	// is interrupted (SIGINT/SIGTERM) rather than completing normally.
+	// The VM's ttl label is left in place so that ReconcileStragglers (or
+	// an external reaper) still cleans it up once the ttl elapses.
+	LeaveRunningOnShutdown bool
+
+	// LogTransport selects which Ops Agent receiver type to exercise.
+	// Defaults to TransportFiles.
+	LogTransport LogTransport
+
+	// ResourceSampling, if non-nil and enabled, samples the Ops Agent's
+	// own resource usage for the life of the run. See
+	// ResourceSamplingConfig for details.
+	ResourceSampling *ResourceSamplingConfig
+}
+
+// Result is what RunSoak reports back about a single VM's run, for use
+// in fleet summaries.
+type Result struct {
+	Spec SoakSpec
+	// LossPct is the end-to-end delivery loss percentage observed, or 0
+	// if verification was not enabled.
+	LossPct float64
+	// ObservedLogsPerSec is the entries/sec actually confirmed delivered
+	// over the run, or 0 if verification was not enabled. This is what
+	// lets a fleet summary tabulate throughput, not just loss, per cell.
+	ObservedLogsPerSec float64
+	Err                error
+}
+
+// RunSoak launches a VM per spec, starts the log generator on it, and
+// (if spec.Verification is set) verifies delivery before returning. On
+// normal completion the VM is left running until its ttl label expires,
+// same as before this package existed. If ctx is canceled mid-run
+// (SIGINT/SIGTERM, see main's signal handling, or a detected
+// preemption), RunSoak logs a final status line and deletes the VM
+// immediately unless spec.LeaveRunningOnShutdown is set. For a run that
+// blocks for its whole life (spec.Verification or spec.ResourceSampling
+// enabled), a detected preemption is also reported back as Result.Err,
+// distinct from a verified run that completed normally within
+// MAX_LOSS_PCT (which also unblocks via ctx being done, but isn't a
+// failure). A run with neither enabled returns as soon as the log
+// generator starts, too quickly for preemption to be observable.
+func RunSoak(ctx context.Context, logger *log.Logger, spec SoakSpec) Result {
+	lossPct, observedRate, err := runSoak(ctx, logger, spec)
+	return Result{Spec: spec, LossPct: lossPct, ObservedLogsPerSec: observedRate, Err: err}
+}
+
+func runSoak(ctx context.Context, logger *log.Logger, spec SoakSpec) (float64, float64, error) {
+	if err := validateLogTransport(spec.LogTransport); err != nil {
+		return 0, 0, err
+	}
+	runID := uuid.New().String()
+
+	// Create the VM.
+	options := gce.VMOptions{
+		Platform:    spec.Distro,
+		Name:        spec.VMName,
+		MachineType: "e2-standard-16",
+		Labels: map[string]string{
+			"ttl":        strconv.Itoa(int(spec.TTL / time.Minute)),
+			"managed-by": managedByLabel,
+		},
+		Metadata: map[string]string{
+			// This is to avoid Windows updates and reboots (b/295165549), and
+			// also to avoid throughput blips when the OS Config agent runs
+			// periodically.
+			"osconfig-disabled-features": "tasks",
+		},
+		ExtraCreateArguments: []string{"--boot-disk-size=4000GB"},
+	}
+	vm, err := gce.CreateInstance(ctx, logger, options)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// runCtx is used for everything from here on, so that a detected
+	// preemption unwinds the rest of the run the same way a
+	// SIGINT/SIGTERM-triggered cancellation of ctx would.
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	preemptionDetected := watchForPreemption(runCtx, cancelRun, logger, vm)
+	defer func() {
+		// A cancellation that isn't ours to attribute to preemption, and
+		// isn't the parent's deadline elapsing, is a user-initiated
+		// shutdown (Ctrl-C, SIGTERM, or the parent fleet run being torn
+		// down).
+		switch {
+		case preemptionDetected():
+			logger.Printf("soak: VM %s was preempted mid-run", vm.Name)
+		case runCtx.Err() == nil, errors.Is(runCtx.Err(), context.DeadlineExceeded):
+			// Completed normally (the launcher's 60-minute budget elapsing
+			// is how a verified or sampled run ends); the ttl label handles
+			// cleanup.
+			return
+		default:
+			logger.Printf("soak: run for VM %s interrupted: %v", vm.Name, runCtx.Err())
+		}
+		if spec.LeaveRunningOnShutdown {
+			logger.Printf("soak: leaving VM %s running until its ttl label expires", vm.Name)
+			return
+		}
+		// Use a fresh context: ctx is already canceled, but teardown
+		// should still happen.
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := gce.DeleteInstance(cleanupCtx, logger, vm); err != nil {
+			logger.Printf("soak: failed to delete VM %s during shutdown: %v", vm.Name, err)
+		}
+	}()
+
+	logPath := "/tmp/tail_file"
+	debugLogPath := "/tmp/log_generator.log"
+	transport := spec.LogTransport
+
+	if transport == TransportEventLog && !gce.IsWindows(vm.Platform) {
+		return 0, 0, fmt.Errorf("LOG_TRANSPORT=%s is only supported on Windows, got platform %q", transport, vm.Platform)
+	}
+	// No firewall rule is opened for the network transports (syslog/tcp/
+	// fluent_forward): the generator always dials the agent at
+	// 127.0.0.1 (see usesNetworkTransport), so transportPort never needs
+	// to be reachable from outside the VM.
+
+	// Install the Ops Agent with a config telling it to receive logs over
+	// the configured transport, plus debugLogPath for debugging.
+	config := receiversConfig(transport, logPath, debugLogPath)
+	if err := agents.SetupOpsAgent(runCtx, logger, vm, config); err != nil {
+		return 0, 0, err
+	}
+
+	if err := startLogGenerator(runCtx, logger, vm, transport, spec, logPath, debugLogPath, runID); err != nil {
+		return 0, 0, err
+	}
+
+	samplingEnabled := spec.ResourceSampling != nil && spec.ResourceSampling.Enabled
+	if samplingEnabled {
+		sampler := newResourceSampler(*spec.ResourceSampling, vm, logger, matrixCell{
+			Distro:         spec.Distro,
+			LogRate:        spec.LogRate,
+			LogSizeInBytes: spec.LogSizeInBytes,
+		})
+		// samplerCtx is its own cancelable child of runCtx, rather than
+		// runCtx itself: canceling it to stop the sampler on the way out
+		// must not make runCtx.Err() non-nil, which the shutdown-teardown
+		// defer above relies on to tell a normal completion from a real
+		// interruption.
+		samplerCtx, cancelSampler := context.WithCancel(runCtx)
+		samplerDone := make(chan struct{})
+		go func() {
+			defer close(samplerDone)
+			sampler.run(samplerCtx)
+		}()
+		defer func() {
+			// Stop the sampler and wait for it to actually exit before
+			// reporting: report() only sees whatever sampler.run
+			// appended so far, so calling it first (defers unwind LIFO)
+			// would race a sampler that's still collecting.
+			cancelSampler()
+			<-samplerDone
+			sampler.report()
+		}()
+	}
+
+	if spec.Verification == nil || !spec.Verification.Enabled {
+		if samplingEnabled {
+			// Nothing else blocks for the life of the run, so without
+			// this the sampler would only get to run for however long
+			// the calls above took, not the full soak.
+			<-runCtx.Done()
+		}
+		if preemptionDetected() {
+			return 0, 0, fmt.Errorf("VM %s was preempted mid-run", vm.Name)
+		}
+		return 0, 0, nil
+	}
+
+	verifier := newDeliveryVerifier(*spec.Verification, spec.Verification.Project, runID, logger)
+	lossPct, observedRate, err := verifier.run(runCtx, generatedCounter(vm, logger, debugLogPath, spec))
+	if err != nil {
+		return lossPct, observedRate, fmt.Errorf("delivery verification failed: %w", err)
+	}
+	// verifier.run returns a nil error on context cancellation, since
+	// that's also how a successful run that never exceeded MAX_LOSS_PCT
+	// ends. A preempted VM needs to be reported as a failure some other
+	// way, since neither the fleet summary's per-cell Error nor the
+	// launcher's exit code would otherwise reflect it.
+	if preemptionDetected() {
+		return lossPct, observedRate, fmt.Errorf("VM %s was preempted mid-run", vm.Name)
+	}
+	logger.Printf("delivery verification finished: %.2f%% loss over the run, %.1f entries/sec observed", lossPct, observedRate)
+	return lossPct, observedRate, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration_test
+
+package soak
+
+import (
+	"fmt"
+)
+
+// LogTransport selects which Ops Agent receiver type the soak test
+// exercises. The zero value, "", is handled the same as TransportFiles,
+// the original file-tailing behavior; the rest turn the soak into a
+// receiver-coverage matrix instead of a files-only test.
+type LogTransport string
+
+const (
+	TransportFiles         LogTransport = "files"
+	TransportSyslog        LogTransport = "syslog"
+	TransportSyslogUDP     LogTransport = "syslog_udp"
+	TransportTCP           LogTransport = "tcp"
+	TransportFluentForward LogTransport = "fluent_forward"
+	TransportEventLog      LogTransport = "eventlog"
+	TransportDockerJSON    LogTransport = "docker_json_file"
+)
+
+// transportPort is the port the generator and the Ops Agent receiver
+// agree on for transports that need one. It's fixed rather than
+// configurable since each soak VM only ever runs one generator.
+const transportPort = 5170
+
+func validateLogTransport(t LogTransport) error {
+	switch t {
+	case "", TransportFiles, TransportSyslog, TransportSyslogUDP, TransportTCP, TransportFluentForward, TransportEventLog, TransportDockerJSON:
+		return nil
+	default:
+		return fmt.Errorf("unrecognized LOG_TRANSPORT %q", t)
+	}
+}
+
+// receiversConfig returns the `logging:` block of the Ops Agent config
+// appropriate for transport, watching/listening wherever the generator
+// (started with a matching --log-write-type) will write to.
+func receiversConfig(transport LogTransport, logPath, debugLogPath string) string {
+	debugReceiver := fmt.Sprintf(`    generator_debug_logs:
+      type: files
+      include_paths:
+      - %s
+`, debugLogPath)
+
+	var mainReceiver string
+	switch transport {
+	case TransportSyslog, TransportSyslogUDP:
+		protocol := "tcp"
+		if transport == TransportSyslogUDP {
+			protocol = "udp"
+		}
+		mainReceiver = fmt.Sprintf(`    mylog_source:
+      type: syslog
+      transport_protocol: %s
+      listen_host: 0.0.0.0
+      listen_port: %d
+`, protocol, transportPort)
+	case TransportTCP, TransportFluentForward:
+		mainReceiver = fmt.Sprintf(`    mylog_source:
+      type: fluent_forward
+      listen_host: 0.0.0.0
+      listen_port: %d
+`, transportPort)
+	case TransportEventLog:
+		mainReceiver = `    mylog_source:
+      type: windows_event_log
+      channels: [Application]
+`
+	case TransportDockerJSON:
+		mainReceiver = `    mylog_source:
+      type: files
+      include_paths:
+      - /var/lib/docker/containers/*/*-json.log
+`
+	default: // TransportFiles, ""
+		mainReceiver = fmt.Sprintf(`    mylog_source:
+      type: files
+      include_paths:
+      - %s
+`, logPath)
+	}
+
+	return fmt.Sprintf(`logging:
+  receivers:
+%s%s  exporters:
+    google:
+      type: google_cloud_logging
+  service:
+    pipelines:
+      my_pipeline:
+        receivers:
+        - mylog_source
+        - generator_debug_logs
+        exporters: [google]
+`, mainReceiver, debugReceiver)
+}
+
+// logGeneratorWriteType maps transport to the --log-write-type value
+// log_generator.py expects. Only called for the transports
+// startPythonLogGenerator handles; TransportEventLog and
+// TransportDockerJSON take their own code paths in generator.go.
+func logGeneratorWriteType(transport LogTransport) string {
+	switch transport {
+	case TransportSyslog:
+		return "syslog_tcp"
+	case TransportSyslogUDP:
+		return "syslog_udp"
+	case TransportTCP, TransportFluentForward:
+		return "tcp"
+	default:
+		return "file"
+	}
+}
+
+// usesNetworkTransport reports whether transport has the generator
+// connect to transportPort over a socket rather than appending to a
+// file. The generator always dials 127.0.0.1 (see
+// startPythonLogGenerator), so this never needs to cross the VM's
+// firewall: the agent's receiver and the generator are colocated on
+// the same VM for every transport this soak test exercises.
+func usesNetworkTransport(transport LogTransport) bool {
+	switch transport {
+	case TransportSyslog, TransportSyslogUDP, TransportTCP, TransportFluentForward:
+		return true
+	default:
+		return false
+	}
+}
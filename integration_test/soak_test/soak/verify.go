@@ -0,0 +1,372 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration_test
+
+package soak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging/logadmin"
+	"cloud.google.com/go/pubsub"
+)
+
+// VerificationConfig controls the optional delivery-verification
+// subsystem, populated from the environment variables documented in the
+// launcher's package doc comment.
+type VerificationConfig struct {
+	// Enabled turns on delivery verification. Set via VERIFY_DELIVERY=true.
+	Enabled bool
+	// Project is the GCP project to query Cloud Logging / Pub/Sub in.
+	Project string
+	// Mode is either "logging_api" (poll Cloud Logging directly) or
+	// "pubsub" (drain a sink through a Pub/Sub subscription).
+	Mode string
+	// MaxLossPct is the loss percentage, over the whole run, above which
+	// RunSoak returns an error. Set via MAX_LOSS_PCT, e.g. "1.5".
+	MaxLossPct float64
+	// Window is how often delivery stats are computed and logged.
+	Window time.Duration
+	// PubsubTopic/PubsubSubscription are only used when Mode is "pubsub".
+	PubsubTopic        string
+	PubsubSubscription string
+}
+
+// VerificationConfigFromEnv builds a VerificationConfig from the
+// VERIFY_DELIVERY, VERIFICATION_MODE, MAX_LOSS_PCT, and
+// VERIFICATION_PUBSUB_* environment variables.
+func VerificationConfigFromEnv(project string) (VerificationConfig, error) {
+	cfg := VerificationConfig{
+		Enabled:            getenvBool("VERIFY_DELIVERY", false),
+		Project:            project,
+		Mode:               getenvDefault("VERIFICATION_MODE", "logging_api"),
+		Window:             time.Minute,
+		PubsubTopic:        getenvDefault("VERIFICATION_PUBSUB_TOPIC", ""),
+		PubsubSubscription: getenvDefault("VERIFICATION_PUBSUB_SUBSCRIPTION", ""),
+	}
+	maxLossStr := getenvDefault("MAX_LOSS_PCT", "1.0")
+	maxLoss, err := strconv.ParseFloat(maxLossStr, 64)
+	if err != nil {
+		return VerificationConfig{}, fmt.Errorf("could not parse MAX_LOSS_PCT %q: %w", maxLossStr, err)
+	}
+	cfg.MaxLossPct = maxLoss
+
+	if cfg.Enabled && cfg.Mode != "logging_api" && cfg.Mode != "pubsub" {
+		return VerificationConfig{}, fmt.Errorf("unrecognized VERIFICATION_MODE %q, want logging_api or pubsub", cfg.Mode)
+	}
+	return cfg, nil
+}
+
+func getenvDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getenvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+// generatedEntry mirrors the JSON object emitted by log_generator.py.
+type generatedEntry struct {
+	RunID              string  `json:"run_id"`
+	Seq                int64   `json:"seq"`
+	GeneratedTimestamp float64 `json:"generated_timestamp"`
+}
+
+// deliveryStats summarizes what the verifier observed for a single
+// window of the run.
+type deliveryStats struct {
+	windowStart  time.Time
+	sent         int64
+	received     int64
+	lossPct      float64
+	p50LatencyMs float64
+	p95LatencyMs float64
+	orderingGaps int64
+}
+
+// deliveryVerifier watches for entries tagged with runID and reports
+// loss, latency, and ordering metrics back to the caller. Entries
+// arrive either from polling the Cloud Logging API or from draining a
+// Pub/Sub subscription fed by a log sink; which one is used is decided
+// by VerificationConfig.Mode.
+type deliveryVerifier struct {
+	cfg     VerificationConfig
+	project string
+	runID   string
+	logger  *log.Logger
+
+	// lastSeqSeen is the highest generator sequence number observed so
+	// far across the whole run, so that summarize can detect ordering
+	// gaps that straddle a window boundary instead of just within
+	// whatever one window's poll happens to return. -1 means no entry
+	// has been seen yet.
+	lastSeqSeen int64
+
+	// seenSeqs dedupes entries across polls: fetchWindowFromLoggingAPI
+	// re-queries from runStart every tick rather than sliding the lower
+	// bound forward, so that an entry whose Cloud Logging ingestion lags
+	// past its own window's poll is still counted once it shows up,
+	// instead of falling below every later window's filter and being
+	// permanently recorded as lost.
+	seenSeqs map[int64]bool
+}
+
+func newDeliveryVerifier(cfg VerificationConfig, project, runID string, logger *log.Logger) *deliveryVerifier {
+	return &deliveryVerifier{cfg: cfg, project: project, runID: runID, logger: logger, lastSeqSeen: -1, seenSeqs: make(map[int64]bool)}
+}
+
+// run polls/drains delivery windows until ctx is canceled, logging a
+// deliveryStats line per window. It returns the cumulative loss
+// percentage and the observed delivery rate (entries/sec received)
+// across the whole run, and an error if loss exceeds cfg.MaxLossPct.
+// generatedCount reports how many entries the generator has actually
+// produced so far; see generatedCounter.
+func (v *deliveryVerifier) run(ctx context.Context, generatedCount func(ctx context.Context) (int64, error)) (float64, float64, error) {
+	var totalSent, totalReceived, lastGeneratedCount int64
+	runStart := time.Now()
+
+	ticker := time.NewTicker(v.cfg.Window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return lossPct(totalSent, totalReceived), observedRate(totalReceived, runStart), nil
+		case <-ticker.C:
+			windowStart := time.Now().Add(-v.cfg.Window)
+			entries, err := v.fetchWindow(ctx, runStart)
+			if err != nil {
+				v.logger.Printf("verifier: failed to fetch window starting %v: %v", windowStart, err)
+				continue
+			}
+			// newEntries is counted towards totalReceived up front, even
+			// if the generatedCount read below fails this tick: dedupe
+			// has already marked these seqs seen, so they'd otherwise
+			// never be counted at all.
+			newEntries := v.dedupe(entries)
+			totalReceived += int64(len(newEntries))
+
+			generated, err := generatedCount(ctx)
+			if err != nil {
+				v.logger.Printf("verifier: failed to read generated count: %v", err)
+				continue
+			}
+			windowSent := generated - lastGeneratedCount
+			lastGeneratedCount = generated
+			stats := v.summarize(windowStart, windowSent, newEntries)
+			totalSent = generated
+			v.logger.Printf("verifier: window=%v sent=%d received=%d loss=%.2f%% p50=%.0fms p95=%.0fms gaps=%d",
+				stats.windowStart, stats.sent, stats.received, stats.lossPct, stats.p50LatencyMs, stats.p95LatencyMs, stats.orderingGaps)
+
+			cumulativeLoss := lossPct(totalSent, totalReceived)
+			if cumulativeLoss > v.cfg.MaxLossPct {
+				return cumulativeLoss, observedRate(totalReceived, runStart), fmt.Errorf("observed loss %.2f%% exceeds MAX_LOSS_PCT %.2f%%", cumulativeLoss, v.cfg.MaxLossPct)
+			}
+		}
+	}
+}
+
+// dedupe filters entries down to the ones not already counted by a
+// prior poll, keyed by the generator's sequence number. fetchWindow's
+// logging_api path re-fetches everything since runStart on every tick
+// (see seenSeqs), so without this an entry would be recounted every
+// window after the one it first appeared in.
+func (v *deliveryVerifier) dedupe(entries []receivedEntry) []receivedEntry {
+	fresh := make([]receivedEntry, 0, len(entries))
+	for _, e := range entries {
+		if v.seenSeqs[e.Seq] {
+			continue
+		}
+		v.seenSeqs[e.Seq] = true
+		fresh = append(fresh, e)
+	}
+	return fresh
+}
+
+// fetchWindow returns every generated entry for v.runID observed since
+// since, using whichever transport cfg.Mode selects. For logging_api,
+// since is the fixed start of the run, not a sliding window lower
+// bound: see seenSeqs for why. fetchWindowFromPubSub ignores since,
+// since draining a subscription only ever returns messages not already
+// acked.
+func (v *deliveryVerifier) fetchWindow(ctx context.Context, since time.Time) ([]receivedEntry, error) {
+	switch v.cfg.Mode {
+	case "pubsub":
+		return v.fetchWindowFromPubSub(ctx)
+	default:
+		return v.fetchWindowFromLoggingAPI(ctx, since)
+	}
+}
+
+// receivedEntry pairs a generatedEntry with the receiveTimestamp Cloud
+// Logging assigned it, which is what makes ingest latency measurable.
+type receivedEntry struct {
+	generatedEntry
+	ReceiveTimestamp time.Time
+}
+
+func (v *deliveryVerifier) fetchWindowFromLoggingAPI(ctx context.Context, since time.Time) ([]receivedEntry, error) {
+	client, err := logadmin.NewClient(ctx, v.project)
+	if err != nil {
+		return nil, fmt.Errorf("logadmin.NewClient: %w", err)
+	}
+	defer client.Close()
+
+	filter := fmt.Sprintf(`jsonPayload.run_id="%s" AND timestamp>="%s"`, v.runID, since.Format(time.RFC3339))
+	var results []receivedEntry
+	it := client.Entries(ctx, logadmin.Filter(filter))
+	for {
+		entry, err := it.Next()
+		if err != nil {
+			break
+		}
+		payload, ok := entry.Payload.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			continue
+		}
+		var ge generatedEntry
+		if err := json.Unmarshal(raw, &ge); err != nil {
+			continue
+		}
+		results = append(results, receivedEntry{generatedEntry: ge, ReceiveTimestamp: entry.ReceiveTimestamp})
+	}
+	return results, nil
+}
+
+func (v *deliveryVerifier) fetchWindowFromPubSub(ctx context.Context) ([]receivedEntry, error) {
+	client, err := pubsub.NewClient(ctx, v.project)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub.NewClient: %w", err)
+	}
+	defer client.Close()
+
+	sub := client.Subscription(v.cfg.PubsubSubscription)
+	pullCtx, cancel := context.WithTimeout(ctx, v.cfg.Window)
+	defer cancel()
+
+	var mu sync.Mutex // guards results, since Receive invokes the callback from multiple goroutines
+	var results []receivedEntry
+	err = sub.Receive(pullCtx, func(_ context.Context, msg *pubsub.Message) {
+		defer msg.Ack()
+		// A log sink publishes each LogEntry as JSON, with the
+		// generator's entry under jsonPayload.
+		var logEntry struct {
+			JSONPayload      generatedEntry `json:"jsonPayload"`
+			ReceiveTimestamp time.Time      `json:"receiveTimestamp"`
+		}
+		if err := json.Unmarshal(msg.Data, &logEntry); err != nil || logEntry.JSONPayload.RunID != v.runID {
+			// Either malformed, or a leftover message from an earlier
+			// run on this same subscription. fleet.Run refuses to run
+			// pubsub verification across more than one concurrent cell,
+			// since Pub/Sub load-balances (rather than broadcasts)
+			// messages across concurrent Receive callers on one
+			// subscription, so acking a mismatched message here can't
+			// steal it from another cell's verifier.
+			return
+		}
+		entry := receivedEntry{generatedEntry: logEntry.JSONPayload, ReceiveTimestamp: logEntry.ReceiveTimestamp}
+		mu.Lock()
+		results = append(results, entry)
+		mu.Unlock()
+	})
+	if err != nil && pullCtx.Err() == nil {
+		return nil, fmt.Errorf("sub.Receive: %w", err)
+	}
+	return results, nil
+}
+
+func (v *deliveryVerifier) summarize(windowStart time.Time, sent int64, entries []receivedEntry) deliveryStats {
+	stats := deliveryStats{
+		windowStart: windowStart,
+		sent:        sent,
+		received:    int64(len(entries)),
+	}
+	stats.lossPct = lossPct(sent, stats.received)
+
+	latencies := make([]float64, 0, len(entries))
+	seqs := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		latencies = append(latencies, e.ReceiveTimestamp.Sub(time.Unix(0, int64(e.GeneratedTimestamp*float64(time.Second)))).Seconds()*1000)
+		seqs = append(seqs, e.Seq)
+	}
+	sort.Float64s(latencies)
+	stats.p50LatencyMs = percentile(latencies, 0.50)
+	stats.p95LatencyMs = percentile(latencies, 0.95)
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	prevSeq := v.lastSeqSeen
+	for _, seq := range seqs {
+		if prevSeq >= 0 && seq != prevSeq+1 {
+			stats.orderingGaps++
+		}
+		prevSeq = seq
+	}
+	if len(seqs) > 0 && seqs[len(seqs)-1] > v.lastSeqSeen {
+		v.lastSeqSeen = seqs[len(seqs)-1]
+	}
+	return stats
+}
+
+func lossPct(sent, received int64) float64 {
+	if sent == 0 {
+		return 0
+	}
+	lost := sent - received
+	if lost < 0 {
+		lost = 0
+	}
+	return float64(lost) / float64(sent) * 100
+}
+
+// observedRate returns the entries/sec actually received since
+// runStart, for the fleet summary's throughput column.
+func observedRate(totalReceived int64, runStart time.Time) float64 {
+	elapsed := time.Since(runStart).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(totalReceived) / elapsed
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx]
+}